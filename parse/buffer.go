@@ -0,0 +1,130 @@
+package parse
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// source supplies the raw bytes a lexer decodes runes from. A plain string
+// satisfies it trivially; a streaming reader needs to grow its buffer on
+// demand and, once the lexer is done with a prefix, may discard it.
+type source interface {
+	// decodeAt ensures the byte at pos is available and returns the rune
+	// starting there along with its width in bytes, or (eof, 0) once the
+	// source is exhausted.
+	decodeAt(pos Pos) (r rune, width Pos)
+
+	// slice returns the bytes between start and end. Both must already
+	// have been made available by a prior decodeAt.
+	slice(start, end Pos) string
+
+	// compact discards everything before start and returns how much was
+	// discarded, so the caller can rebase any offsets it holds by that
+	// amount. A source that never needs to shed memory (a plain string)
+	// always returns 0.
+	compact(start Pos) Pos
+}
+
+// stringSource is a source backed entirely by an in-memory string, as used
+// by lex. It never needs to grow or compact.
+type stringSource string
+
+func (s stringSource) decodeAt(pos Pos) (rune, Pos) {
+	if int(pos) >= len(s) {
+		return eof, 0
+	}
+	r, w := utf8.DecodeRuneInString(string(s)[pos:])
+	return r, Pos(w)
+}
+
+func (s stringSource) slice(start, end Pos) string {
+	return string(s)[start:end]
+}
+
+func (s stringSource) compact(start Pos) Pos {
+	return 0
+}
+
+// errSource is implemented by a source that can stop producing runes for
+// a reason other than the input legitimately ending, e.g. a readerBuffer
+// whose underlying io.Reader failed. lexer.Err uses this to let the
+// parser tell the two apart once draining is done.
+type errSource interface {
+	// readErr returns the error that made the source stop, or nil if it
+	// either hasn't stopped or stopped because the input legitimately
+	// ended.
+	readErr() error
+}
+
+// readerBuffer is a source backed by an io.Reader, read into memory only as
+// the lexer asks for more. This is what lexReader uses so that very large
+// or piped journals don't need to be buffered up front.
+type readerBuffer struct {
+	r    io.Reader
+	data []byte
+	eof  bool
+	err  error // set when a Read fails with something other than io.EOF
+}
+
+// newReaderBuffer wraps r in a growable, compacting rune buffer.
+func newReaderBuffer(r io.Reader) *readerBuffer {
+	return &readerBuffer{r: r}
+}
+
+// grow reads more from the underlying reader, appending it to data. It's a
+// no-op once the reader has reported io.EOF or any other error: either way,
+// nothing more is coming, though a non-EOF error is stashed in b.err so the
+// caller can tell the two apart via readErr instead of treating a failed
+// read as the journal having simply ended.
+func (b *readerBuffer) grow() {
+	if b.eof {
+		return
+	}
+	var chunk [4096]byte
+	n, err := b.r.Read(chunk[:])
+	if n > 0 {
+		b.data = append(b.data, chunk[:n]...)
+	}
+	if err != nil {
+		b.eof = true
+		if err != io.EOF {
+			b.err = err
+		}
+	}
+}
+
+func (b *readerBuffer) readErr() error {
+	return b.err
+}
+
+func (b *readerBuffer) decodeAt(pos Pos) (rune, Pos) {
+	for int(pos) >= len(b.data) && !b.eof {
+		b.grow()
+	}
+	if int(pos) >= len(b.data) {
+		return eof, 0
+	}
+	// A multi-byte rune (e.g. the "£" in isCommoditySymbol's own example)
+	// can straddle two reads, so utf8.FullRune must hold before decoding -
+	// otherwise DecodeRune sees a truncated sequence and misreports it as
+	// a one-byte RuneError, corrupting the token stream.
+	for !utf8.FullRune(b.data[pos:]) && !b.eof {
+		b.grow()
+	}
+	r, w := utf8.DecodeRune(b.data[pos:])
+	return r, Pos(w)
+}
+
+func (b *readerBuffer) slice(start, end Pos) string {
+	return string(b.data[start:end])
+}
+
+func (b *readerBuffer) compact(start Pos) Pos {
+	if start <= 0 {
+		return 0
+	}
+	// Re-slice onto a fresh array rather than just data[start:], so the
+	// discarded prefix doesn't keep pinning memory via the old backing array.
+	b.data = append([]byte(nil), b.data[start:]...)
+	return start
+}
@@ -2,16 +2,18 @@ package parse
 
 import (
 	"fmt"
+	"io"
 	"strings"
 	"unicode"
-	"unicode/utf8"
 )
 
 // item represents a token or text string returned from the scanner.
 type item struct {
-	typ itemType // The type of this item.
-	pos Pos      // The starting position, in bytes, of this item in the input string.
-	val string   // The value of this item.
+	typ  itemType // The type of this item.
+	pos  Pos      // The starting position, in bytes, of this item in the input string.
+	line int      // The line number, 1-based, on which this item starts.
+	col  int      // The column number, 1-based, on which this item starts.
+	val  string   // The value of this item.
 }
 
 func (i item) String() string {
@@ -19,7 +21,7 @@ func (i item) String() string {
 	case i.typ == itemEOF:
 		return "EOF"
 	case i.typ == itemError:
-		return i.val
+		return fmt.Sprintf("line %d, col %d: %s", i.line, i.col, i.val)
 	case i.typ > itemKeyword:
 		return fmt.Sprintf("<%s>", i.val)
 	case len(i.val) > 10:
@@ -50,10 +52,22 @@ const (
 	itemIdentifier
 	itemLeftParen
 	itemRightParen
-	itemNeg      // '-'
+	itemLeftBrace    // '{', opens a lot price annotation
+	itemRightBrace   // '}'
+	itemLeftBracket  // '[', opens a lot date annotation
+	itemRightBracket // ']'
+	itemAt           // '@', unit price
+	itemDoubleAt     // '@@', total price
+	itemNeg          // '-'
 	itemQuantity // "123.1234", with optional decimals. No scientific notation, complex, imaginary, etc..
 	itemTilde
 	itemPeriodExpr
+	itemPeriodKeyword // "daily", "weekly", "monthly", "quarterly", "yearly"
+	itemEvery         // "every", as in "every 2 weeks"
+	itemFrom          // "from", introducing a period's start date
+	itemTo            // "to", introducing a period's end date
+	itemOn            // "on", introducing a specific day, e.g. "on the 15th"
+	itemInteger       // a bare count, e.g. the "2" in "every 2 weeks"
 	itemDot // to form numbers, with itemInteger + optionally: itemDot + itemInteger
 	itemStatus
 	itemAccountName // only a name like "Expenses:Misc"
@@ -69,6 +83,7 @@ const (
 	itemEnd
 	itemAlias
 	itemPrice
+	itemPayee
 	// itemDef
 	// itemYear
 	// itemBucket
@@ -78,13 +93,22 @@ const (
 	// itemDefaultCommodity
 )
 
-// key must contain anything after `itemKeyword` in the preceding list.
-var key = map[string]itemType{
+// topLevelKeywords are recognized only when a bare word begins a new
+// top-level line, i.e. one not inside an account directive's indented
+// body. See resolveKeyword.
+var topLevelKeywords = map[string]itemType{
 	"include": itemInclude,
 	"account": itemAccountKeyword,
-	"end":     itemEnd,
-	"alias":   itemAlias,
 	"P":       itemPrice,
+	"end":     itemEnd,
+}
+
+// accountBlockKeywords are recognized only when a bare word begins a new
+// line inside an account directive's indented body. See resolveKeyword.
+var accountBlockKeywords = map[string]itemType{
+	"alias": itemAlias,
+	"payee": itemPayee,
+	"end":   itemEnd,
 }
 
 const eof = -1
@@ -95,7 +119,7 @@ type stateFn func(*lexer) stateFn
 // lexer holds the state of the scanner.
 type lexer struct {
 	name       string    // the name of the input; used only for error reports
-	input      string    // the string being scanned
+	src        source    // supplies the bytes being scanned
 	state      stateFn   // the next lexing function to enter
 	pos        Pos       // current position in the input
 	start      Pos       // start position of this item
@@ -103,6 +127,29 @@ type lexer struct {
 	lastPos    Pos       // position of most recent item returned by nextItem
 	items      chan item // channel of scanned items
 	parenDepth int       // nesting depth of ( ) exprs
+	stack      []stateFn // state functions to resume, most recent last
+
+	line     int // 1-based line number of pos
+	col      int // number of runes consumed so far on the current line
+	prevCol  int // col before the last newline crossed by next(), for backup()
+	lastLine int // line of the most recent item returned by nextItem
+
+	startLine int // line on which start sits
+	startCol  int // 1-based column on which start sits
+
+	base Pos // cumulative amount compact has discarded from src so far;
+	// added back to l.start/l.pos when reporting an item's absolute
+	// position, since src.compact() rebases them to the still-buffered
+	// prefix, not the original input.
+
+	// atLineStart, atLineHead and inAccountBlock are consumer-side
+	// context, updated by nextItem as items stream past, not by the
+	// lexing goroutine. They're what resolveKeyword uses to decide
+	// whether a bare word like "end" is acting as a keyword or is just
+	// an identifier (e.g. an account name component). See resolveKeyword.
+	atLineStart    bool // true if the next item is the first non-space item on its line
+	atLineHead     bool // true for exactly one item: the very first item of a new physical line
+	inAccountBlock bool // true while inside an account directive's indented body
 }
 
 const (
@@ -111,13 +158,19 @@ const (
 
 // next returns the next rune in the input.
 func (l *lexer) next() rune {
-	if int(l.pos) >= len(l.input) {
-		l.width = 0
+	r, w := l.src.decodeAt(l.pos)
+	l.width = w
+	l.pos += l.width
+	if r == eof {
 		return eof
 	}
-	r, w := utf8.DecodeRuneInString(l.input[l.pos:])
-	l.width = Pos(w)
-	l.pos += l.width
+	if r == '\n' {
+		l.line++
+		l.prevCol = l.col
+		l.col = 0
+	} else {
+		l.col++
+	}
 	return r
 }
 
@@ -131,21 +184,47 @@ func (l *lexer) peek() rune {
 // backup steps back one rune. Can only be called once per call of next.
 func (l *lexer) backup() {
 	l.pos -= l.width
+	if l.width == 0 {
+		return
+	}
+	if r, _ := l.src.decodeAt(l.pos); r == '\n' {
+		l.line--
+		l.col = l.prevCol
+	} else {
+		l.col--
+	}
 }
 
 // emit passes an item back to the client.
 func (l *lexer) emit(t itemType) {
-	l.items <- item{t, l.start, l.input[l.start:l.pos]}
+	l.items <- item{t, l.base + l.start, l.startLine, l.startCol, l.src.slice(l.start, l.pos)}
 	l.start = l.pos
+	l.startLine = l.line
+	l.startCol = l.col + 1
+	l.compact()
 }
 
 func (l *lexer) current() string {
-	return l.input[l.start:l.pos]
+	return l.src.slice(l.start, l.pos)
 }
 
 // ignore skips over the pending input before this point.
 func (l *lexer) ignore() {
 	l.start = l.pos
+	l.startLine = l.line
+	l.startCol = l.col + 1
+	l.compact()
+}
+
+// compact lets the source discard anything before l.start, once nothing
+// pending still refers to it, and rebases pos/start by whatever was
+// discarded. For a string-backed source this is a no-op.
+func (l *lexer) compact() {
+	if discarded := l.src.compact(l.start); discarded > 0 {
+		l.start -= discarded
+		l.pos -= discarded
+		l.base += discarded
+	}
 }
 
 // accept consumes the next rune if it's from the valid set.
@@ -164,26 +243,106 @@ func (l *lexer) acceptRun(valid string) {
 	l.backup()
 }
 
-// lineNumber reports which line we're on, based on the position of
+// lineNumber reports which line we're on, based on the line of
 // the previous item returned by nextItem. Doing it this way
 // means we don't have to worry about peek double counting.
 func (l *lexer) lineNumber() int {
-	return 1 + strings.Count(l.input[:l.lastPos], "\n")
+	return l.lastLine
 }
 
 // errorf returns an error token and terminates the scan by passing
 // back a nil pointer that will be the next state, terminating l.nextItem.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- item{itemError, l.start, fmt.Sprintf(format, args...)}
+	l.items <- item{itemError, l.base + l.start, l.startLine, l.startCol, fmt.Sprintf(format, args...)}
 	return nil
 }
 
-// nextItem returns the next item from the input.
-// Called by the parser, not in the lexing goroutine.
+// push saves state on the state stack, to be resumed by a later pop. It
+// lets a state function delegate into a sub-state (a note, a lot
+// annotation, ...) without hard-coding what comes after the sub-state is
+// done scanning.
+func (l *lexer) push(state stateFn) {
+	l.stack = append(l.stack, state)
+}
+
+// pop restores the state most recently saved by push. Popping an empty
+// stack is a lexer bug, not an input error, but we report it the same way
+// the rest of the lexer reports errors: via errorf.
+func (l *lexer) pop() stateFn {
+	if len(l.stack) == 0 {
+		return l.errorf("internal error: state stack underflow")
+	}
+	top := len(l.stack) - 1
+	state := l.stack[top]
+	l.stack = l.stack[:top]
+	return state
+}
+
+// nextItem returns the next item from the input, promoting a bare
+// itemIdentifier to the directive keyword it spells out, if and only if
+// the surrounding context expects one there. Called by the parser, not
+// in the lexing goroutine.
 func (l *lexer) nextItem() item {
-	item := <-l.items
-	l.lastPos = item.pos
-	return item
+	it := <-l.items
+	l.lastPos = it.pos
+	l.lastLine = it.line
+
+	if l.atLineHead {
+		// The very first item of a new physical line tells us whether
+		// an account block's indented body continues (that item is
+		// itemSpace) or has ended (anything else, including a blank
+		// line's itemEOL). This only runs once per line — right here,
+		// on whatever item happens to arrive first — rather than on
+		// every item while atLineStart is still true, so it doesn't
+		// re-fire on the keyword that follows the indent.
+		l.inAccountBlock = l.inAccountBlock && it.typ == itemSpace
+		l.atLineHead = false
+	}
+
+	if it.typ == itemIdentifier {
+		it.typ = l.resolveKeyword(it.val)
+		if it.typ == itemAccountKeyword {
+			l.inAccountBlock = true
+		}
+	}
+
+	switch {
+	case it.typ == itemEOL:
+		l.atLineStart = true
+		l.atLineHead = true
+	case it.typ != itemSpace:
+		l.atLineStart = false
+	}
+
+	return it
+}
+
+// resolveKeyword promotes word to the directive keyword it spells out —
+// itemInclude, itemAccountKeyword, itemAlias, itemEnd, itemPrice or
+// itemPayee — when, and only when, it begins a line in a context that
+// expects one: a top-level line for include/account/P/end, or a line
+// inside an account block's indented body for alias/payee/end. Anywhere
+// else the word is left as a plain itemIdentifier, the same as any other
+// word lexIdentifier scans.
+//
+// This is what lets "End" remain an ordinary word in `account End` or
+// `Assets:End:Cash` while still recognizing "end" where a keyword is
+// genuinely expected: lexIdentifier itself never makes this promotion,
+// so recognizing a keyword can never swallow a word that merely happens
+// to spell one, the way PromQL moved the same disambiguation out of its
+// lexer and into its parser.
+func (l *lexer) resolveKeyword(word string) itemType {
+	if !l.atLineStart {
+		return itemIdentifier
+	}
+	keywords := topLevelKeywords
+	if l.inAccountBlock {
+		keywords = accountBlockKeywords
+	}
+	if t, ok := keywords[word]; ok {
+		return t
+	}
+	return itemIdentifier
 }
 
 // drain drains the output so the lexing goroutine will exit.
@@ -195,10 +354,27 @@ func (l *lexer) drain() {
 
 // lex creates a new scanner for the input string.
 func lex(name, input string) *lexer {
+	return lexSource(name, stringSource(input))
+}
+
+// lexReader creates a new scanner that reads from r, growing its buffer on
+// demand instead of requiring the whole journal in memory up front. It
+// behaves identically to lex in every other respect.
+func lexReader(name string, r io.Reader) *lexer {
+	return lexSource(name, newReaderBuffer(r))
+}
+
+// lexSource creates a new scanner over src, shared by lex and lexReader.
+func lexSource(name string, src source) *lexer {
 	l := &lexer{
-		name:  name,
-		input: input,
-		items: make(chan item),
+		name:        name,
+		src:         src,
+		items:       make(chan item),
+		line:        1,
+		startLine:   1,
+		startCol:    1,
+		atLineStart: true,
+		atLineHead:  true,
 	}
 	go l.run()
 	return l
@@ -212,6 +388,19 @@ func (l *lexer) run() {
 	close(l.items)
 }
 
+// Err reports the first non-EOF error the source hit while reading, if
+// any. A lexer built with lex never has one. One built with lexReader can:
+// its readerBuffer treats a failing Read exactly like a clean io.EOF as far
+// as the lexing goroutine is concerned (eof just stops producing runes),
+// so this is how the parser tells "the journal legitimately ended" from
+// "reading it failed partway through" once draining is done.
+func (l *lexer) Err() error {
+	if es, ok := l.src.(errSource); ok {
+		return es.readErr()
+	}
+	return nil
+}
+
 // Lex State Functions
 
 // lexJournal scans the Ledger file for top-level Ledger constructs.
@@ -243,7 +432,13 @@ func lexJournal(l *lexer) stateFn {
 	return lexJournal
 }
 
-// lexIdentifier scans an alphanumeric.
+// lexIdentifier scans an alphanumeric word and always emits it as a plain
+// itemIdentifier — never a keyword. Whether "include", "account", "end"
+// and the like are keywords here or just words is for nextItem's
+// resolveKeyword to decide, once the item has reached the context that
+// makes that unambiguous; lexIdentifier only needs the raw word itself to
+// know what comes next grammatically (a filename after "include", an
+// account name after "account"/"alias", ...).
 func lexIdentifier(l *lexer) stateFn {
 Loop:
 	for {
@@ -252,27 +447,27 @@ Loop:
 			// absorb.
 		default:
 			l.backup()
-			word := l.input[l.start:l.pos]
+			word := l.current()
 			if !l.atTerminator() {
 				return l.errorf("bad character %#U", r)
 			}
-			switch {
-			case word == "include":
-				l.emit(itemInclude)
+			l.emit(itemIdentifier)
+			switch word {
+			case "include":
 				l.scanSpaces()
 				if !l.scanStringToEOL() {
 					l.errorf("missing filename after 'include'")
 					return nil
 				}
-			case word == "end":
-				l.emit(itemEnd)
+			case "account", "alias":
+				l.scanSpaces()
+				l.scanAccountNameToEOL()
+			case "payee":
+				l.scanSpaces()
+				l.scanStringToEOL()
+			case "end":
 				l.scanSpaces()
 				return lexIdentifier
-				// handle "alias", etc..
-			case key[word] > itemKeyword:
-				l.emit(key[word])
-			default:
-				l.emit(itemIdentifier)
 			}
 			break Loop
 		}
@@ -290,8 +485,75 @@ func (l *lexer) atTerminator() bool {
 
 func lexPeriodicXact(l *lexer) stateFn {
 	l.scanSpaces()
-	l.scanStringNote()
-	return lexPostings
+	return lexPeriodExpr
+}
+
+// lexPeriodExpr scans a periodic transaction's period expression: a
+// sequence of recognized words (the period keywords "daily", "weekly",
+// "monthly", "quarterly", "yearly", plus "every", "from", "to", "on")
+// and bare integers or dates, separated by spaces, up to a note or end
+// of line.
+//
+// The first word that isn't one of these is assumed to be the start of
+// a custom period this lexer doesn't otherwise understand — rather than
+// erroring out, the rest of the expression up to the note/EOL is emitted
+// as a single itemString, the same opaque token this state used to emit
+// for the whole expression, so custom periods still round-trip.
+func lexPeriodExpr(l *lexer) stateFn {
+	for {
+		l.scanSpaces()
+		switch r := l.peek(); {
+		case isEndOfLine(r) || r == eof:
+			return lexPostings
+		case r == ';':
+			l.scanNote()
+			return lexPostings
+		case unicode.IsDigit(r):
+			l.scanPeriodNumber()
+		case unicode.IsLetter(r):
+			for unicode.IsLetter(l.peek()) {
+				l.next()
+			}
+			switch word := l.current(); word {
+			case "daily", "weekly", "monthly", "quarterly", "yearly":
+				l.emit(itemPeriodKeyword)
+			case "every":
+				l.emit(itemEvery)
+			case "from":
+				l.emit(itemFrom)
+			case "to":
+				l.emit(itemTo)
+			case "on":
+				l.emit(itemOn)
+			default:
+				l.scanStringNote()
+				return lexPostings
+			}
+		default:
+			l.scanStringNote()
+			return lexPostings
+		}
+	}
+}
+
+// scanPeriodNumber scans a run of digits as either an itemInteger (a
+// bare count, as in "every 2 weeks") or, if a date separator follows the
+// first run of digits, an itemDate (as in "from 2016/01/01").
+func (l *lexer) scanPeriodNumber() {
+	l.acceptRun("0123456789")
+	if r := l.peek(); r != '/' && r != '-' && r != '.' {
+		l.emit(itemInteger)
+		return
+	}
+	for {
+		switch r := l.peek(); {
+		case unicode.IsDigit(r) || r == '/' || r == '-' || r == '.':
+			l.next()
+		default:
+			l.emit(itemDate)
+			return
+		}
+	}
 }
 
 func (l *lexer) scanStringNote() {
@@ -307,6 +569,7 @@ Loop:
 			l.scanNote()
 			break Loop
 		case isEndOfLine(r):
+			l.backup()
 			if l.current() != "" {
 				l.emit(itemString)
 			}
@@ -441,6 +704,67 @@ Loop:
 	return true
 }
 
+// scanAccountNameToEOL scans the account-name argument of an "account" or
+// "alias" directive, up to a note, end of line, or EOF. The alias form
+// may contain a "=", as in "alias end=Assets:Cash", which is why this
+// doesn't try to parse the name's internal structure the way
+// scanAccountName does for postings.
+func (l *lexer) scanAccountNameToEOL() bool {
+Loop:
+	for {
+		switch r := l.peek(); {
+		case isEndOfLine(r):
+			break Loop
+		case r == eof:
+			break Loop
+		case r == ';':
+			break Loop
+		default:
+			l.next()
+		}
+	}
+	if l.current() == "" {
+		return false
+	}
+	l.emit(itemAccountName)
+	return true
+}
+
+// scanAccountName scans a posting's account name, which runs until a
+// SPACER — two spaces, a tab, or a space and a tab, in either order —
+// that separates it from the posting's amount, or until a note, end of
+// line or EOF if there's no amount. A single space, as in "Spaced
+// child", is part of the name rather than a separator.
+func (l *lexer) scanAccountName() bool {
+Loop:
+	for {
+		switch r := l.peek(); {
+		case isEndOfLine(r), r == eof, r == ';':
+			break Loop
+		case r == '\t':
+			break Loop
+		case r == ' ':
+			spacePos, spaceCol := l.pos, l.col
+			l.next() // consume the space tentatively
+			if n := l.peek(); n == ' ' || n == '\t' {
+				// A second spacer rune in a row: this was the SPACER,
+				// not part of the name. Rewind past the tentative
+				// space, directly rather than via backup(), since
+				// backup() can only undo the single most recent next().
+				l.pos, l.col = spacePos, spaceCol
+				break Loop
+			}
+		default:
+			l.next()
+		}
+	}
+	if l.current() == "" {
+		return false
+	}
+	l.emit(itemAccountName)
+	return true
+}
+
 func lexPostings(l *lexer) stateFn {
 	// Always arrive here with an EOL as first token, or an Account name directly.
 	var expectIndent bool
@@ -472,47 +796,291 @@ func lexPostings(l *lexer) stateFn {
 			//   account values_opt note_opt EOL;
 			l.scanAccountName() // until EOL or until SPACER (two spaces, a tab or one of each)
 			return lexPostingAmount
+		case r == eof:
+			l.emit(itemEOF)
+			return nil
 		}
 		expectIndent = false
 	}
-
-	return lexJournal
 }
 
+// lexPostingAmount scans: values_opt note_opt EOL
+//
+// values_opt:
+//     spacer amount_expr price_opt |
+//     [epsilon]
+//     ;
+//
+// amount_expr: amount | value_expr ;
+//
+// amount:
+//     neg_opt commodity quantity annotation |
+//     quantity commodity annotation ;
+//
+// price_opt: price | [epsilon] ;
+// price:
+//     '@' amount_expr |
+//     '@@' amount_expr            [in this case, it's the whole price]
+//     ;
+//
+// annotation: lot_price_opt lot_date_opt lot_note_opt ;
+//
+// lot_date_opt: date | [epsilon] ;
+// lot_date: '[' date ']' ;
+//
+// lot_price_opt: price | [epsilon] ;
+// lot_price: '{' amount '}' ;
+//
+// lot_note_opt: note | [epsilon] ;
+// lot_note: '(' string ')' ;
 func lexPostingAmount(l *lexer) stateFn {
-	/*
-HERE SCAN: values_opt note_opt EOL
+	l.scanSpaces()
 
-values_opt:
-    spacer amount_expr price_opt |
-    [epsilon]
-    ;
+	switch r := l.peek(); {
+	case isEndOfLine(r) || r == eof || r == ';':
+		l.scanStringNote()
+		return lexPostings // return here before EOL is consumed, to see if we continue the postings...
+	}
 
-amount_expr: amount | value_expr ;
+	if !l.scanAmountExpr() {
+		return nil
+	}
 
-amount:
-    neg_opt commodity quantity annotation |
-    quantity commodity annotation ;
+	// The lot annotation, if any, is scanned as its own chain of states
+	// (lexAnnotationPrice -> lexAnnotationDate -> lexAnnotationNote, each
+	// delegating into lexLotPrice/lexLotDate/lexLotNote in turn) so none of
+	// them need to hard-code what follows. lexPostingPrice resumes once the
+	// whole annotation, if any, has been scanned. The grammar above places
+	// price_opt after annotation, not before it — a lot cost basis comes
+	// before a sale price, e.g. "10 AAPL {$50.00} @ $52.00" — so the price
+	// is scanned there, not here.
+	l.push(lexPostingPrice)
+	return lexAnnotationPrice
+}
 
-price_opt: price | [epsilon] ;
-price:
-    '@' amount_expr |
-    '@@' amount_expr            [in this case, it's the whole price]
-    ;
+// lexPostingPrice scans the posting's price_opt ("@"/"@@" amount_expr),
+// once any lot annotation has already been scanned, then resumes
+// lexPostingNote. It is reached via the state stack, like the
+// lot-annotation states it follows.
+func lexPostingPrice(l *lexer) stateFn {
+	if !l.scanPriceOpt() {
+		return nil
+	}
+	return lexPostingNote(l)
+}
 
-annotation: lot_price_opt lot_date_opt lot_note_opt ;
+// lexPostingNote scans the note_opt and EOL that terminate a posting, once
+// any amount, price and lot annotation have been scanned. It is called
+// directly by lexPostingPrice, which is itself resumed via the state stack
+// once any lot annotation has been scanned.
+func lexPostingNote(l *lexer) stateFn {
+	l.scanSpaces()
+	l.scanStringNote()
+	return lexPostings // return here before EOL is consumed, to see if we continue the postings...
+}
 
-lot_date_opt: date | [epsilon] ;
-lot_date: '[' date ']' ;
+// scanAmountExpr scans `neg_opt commodity quantity` or
+// `neg_opt quantity commodity_opt`, i.e. a commodity symbol used as a prefix
+// ("$100") or as an optional suffix ("100 USD", "-20.00 CAD", "20.00").
+func (l *lexer) scanAmountExpr() bool {
+	if l.peek() == '-' {
+		l.next()
+		l.emit(itemNeg)
+		l.scanSpaces()
+	}
 
-lot_price_opt: price | [epsilon] ;
-lot_price: '{' amount '}' ;
+	switch r := l.peek(); {
+	case r == '"' || unicode.IsLetter(r) || isCommoditySymbol(r):
+		if !l.scanCommodity() {
+			l.errorf("expected commodity")
+			return false
+		}
+		l.scanSpaces()
+		if !l.scanQuantity() {
+			l.errorf("expected quantity after commodity")
+			return false
+		}
+	case unicode.IsDigit(r) || r == '.':
+		if !l.scanQuantity() {
+			l.errorf("expected quantity")
+			return false
+		}
+		l.scanSpaces()
+		l.scanCommodity() // postfix commodity is optional: "20.00" alone is a valid amount
+	default:
+		l.errorf("expected amount, found %#U", r)
+		return false
+	}
+	return true
+}
 
-lot_note_opt: note | [epsilon] ;
-lot_note: '(' string ')' ;
+// scanQuantity scans a decimal quantity: digits with an optional '.' and
+// more digits. No scientific notation, grouping separators, etc..
+func (l *lexer) scanQuantity() bool {
+	start := l.pos
+	l.acceptRun("0123456789")
+	if l.peek() == '.' {
+		l.next()
+		l.acceptRun("0123456789")
+	}
+	if l.pos == start {
+		return false
+	}
+	l.emit(itemQuantity)
+	return true
+}
 
- */
-	return lexPostings // return here before EOL is consumed, to see if we continue the postings...
+// scanCommodity scans a commodity symbol: a quoted string ("MUTF123"), a run
+// of letters (CAD, USD), or a single symbol rune ($, £, ...).
+func (l *lexer) scanCommodity() bool {
+	switch r := l.peek(); {
+	case r == '"':
+		l.next()
+	QuoteLoop:
+		for {
+			switch l.next() {
+			case '"':
+				break QuoteLoop
+			case eof, '\n', '\r':
+				l.errorf("unterminated quoted commodity")
+				return false
+			}
+		}
+		l.emit(itemCommodity)
+		return true
+	case unicode.IsLetter(r):
+		for unicode.IsLetter(l.peek()) {
+			l.next()
+		}
+		l.emit(itemCommodity)
+		return true
+	case isCommoditySymbol(r):
+		l.next()
+		l.emit(itemCommodity)
+		return true
+	}
+	return false
+}
+
+// scanPriceOpt scans an optional `@ amount_expr` (unit price) or
+// `@@ amount_expr` (total price).
+func (l *lexer) scanPriceOpt() bool {
+	l.scanSpaces()
+	if l.peek() != '@' {
+		return true
+	}
+	l.next()
+	if l.peek() == '@' {
+		l.next()
+		l.emit(itemDoubleAt)
+	} else {
+		l.emit(itemAt)
+	}
+	l.scanSpaces()
+	return l.scanAmountExpr()
+}
+
+// lexAnnotationPrice scans the optional lot price `{amount}`, then hands
+// off to lexAnnotationDate, in grammar order: lot_price_opt lot_date_opt
+// lot_note_opt.
+func lexAnnotationPrice(l *lexer) stateFn {
+	l.scanSpaces()
+	if l.peek() == '{' {
+		l.push(lexAnnotationDate)
+		return lexLotPrice
+	}
+	return lexAnnotationDate(l)
+}
+
+// lexAnnotationDate scans the optional lot date `[date]`, then hands off to
+// lexAnnotationNote.
+func lexAnnotationDate(l *lexer) stateFn {
+	l.scanSpaces()
+	if l.peek() == '[' {
+		l.push(lexAnnotationNote)
+		return lexLotDate
+	}
+	return lexAnnotationNote(l)
+}
+
+// lexAnnotationNote scans the optional lot note `(note)`, then resumes
+// whatever lexPostingAmount pushed before entering the annotation.
+func lexAnnotationNote(l *lexer) stateFn {
+	l.scanSpaces()
+	if l.peek() == '(' {
+		return lexLotNote
+	}
+	return l.pop()
+}
+
+// lexLotPrice scans a lot price annotation: '{' amount '}', then resumes
+// the state pushed before entering it.
+func lexLotPrice(l *lexer) stateFn {
+	l.next() // consume '{'
+	l.emit(itemLeftBrace)
+	l.scanSpaces()
+	if !l.scanAmountExpr() {
+		return nil
+	}
+	l.scanSpaces()
+	if l.next() != '}' {
+		return l.errorf("missing closing '}' in lot price annotation")
+	}
+	l.emit(itemRightBrace)
+	return l.pop()
+}
+
+// lexLotDate scans a lot date annotation: '[' date ']', then resumes the
+// state pushed before entering it.
+func lexLotDate(l *lexer) stateFn {
+	l.next() // consume '['
+	l.emit(itemLeftBracket)
+DateLoop:
+	for {
+		switch r := l.peek(); {
+		case r == ']':
+			break DateLoop
+		case isEndOfLine(r) || r == eof:
+			return l.errorf("missing closing ']' in lot date annotation")
+		default:
+			l.next()
+		}
+	}
+	if l.current() != "" {
+		l.emit(itemDate)
+	}
+	l.next() // consume ']'
+	l.emit(itemRightBracket)
+	return l.pop()
+}
+
+// lexLotNote scans a lot note annotation: '(' string ')', then resumes the
+// state pushed before entering it.
+func lexLotNote(l *lexer) stateFn {
+	l.next() // consume '('
+	l.emit(itemLeftParen)
+	l.scanStringUntil(')')
+	if l.next() != ')' {
+		return l.errorf("missing closing ')' in lot note annotation")
+	}
+	l.emit(itemRightParen)
+	return l.pop()
+}
+
+// isCommoditySymbol reports whether r is a single-rune commodity symbol such
+// as '$' or '£', as opposed to a letter-based commodity like "CAD".
+func isCommoditySymbol(r rune) bool {
+	switch {
+	case r == eof, unicode.IsDigit(r), unicode.IsLetter(r):
+		return false
+	case isSpace(r) || isEndOfLine(r):
+		return false
+	case r == '"' || r == '-' || r == '@' || r == ';':
+		return false
+	case r == '{' || r == '}' || r == '[' || r == ']' || r == '(' || r == ')':
+		return false
+	}
+	return true
 }
 
 // isSpace reports whether r is a space character.
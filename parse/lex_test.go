@@ -2,8 +2,12 @@ package parse
 
 import (
 	"fmt"
-	"testing"
+	"io"
+	"reflect"
 	rtdebug "runtime/debug"
+	"strings"
+	"testing"
+	"testing/iotest"
 )
 
 // Make the types prettyprint.
@@ -29,158 +33,349 @@ type lexTest struct {
 }
 
 var (
-	tEOF = item{itemEOF, 0, ""}
-	tEOL = item{itemEOL, 0, "\n"}
+	tEOF = item{typ: itemEOF, val: ""}
+	tEOL = item{typ: itemEOL, val: "\n"}
 )
 
 var lexTests = []lexTest{
 	{"empty", "", []item{tEOF}},
-	{"spaces", " \t\n", []item{{itemSpace, 0, " \t"}, tEOL, tEOF}},
+	{"spaces", " \t\n", []item{{typ: itemSpace, val: " \t"}, tEOL, tEOF}},
 	{"account", `account Account`, []item{
-		{itemAccountKeyword, 0, "account"},
-		{itemSpace, 0, " "},
-		{itemAccountName, 0, "Account"},
+		{typ: itemAccountKeyword, val: "account"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Account"},
 		tEOF,
 	}},
 	{"account with alias", "account Account\n alias act", []item{
-		{itemAccountKeyword, 0, "account"},
-		{itemSpace, 0, " "},
-		{itemAccountName, 0, "Account"},
+		{typ: itemAccountKeyword, val: "account"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Account"},
 		tEOL,
-		{itemSpace, 0, " "},
-		{itemAlias, 0, "alias"},
-		{itemSpace, 0, " "},
-		{itemAccountName, 0, "act"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAlias, val: "alias"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "act"},
 		tEOF,
 	}},
 	{"account with 2 aliases", "account Account\n alias act1\n alias act2", []item{
-		{itemAccountKeyword, 0, "account"},
-		{itemSpace, 0, " "},
-		{itemAccountName, 0, "Account"},
+		{typ: itemAccountKeyword, val: "account"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Account"},
 		tEOL,
-		{itemSpace, 0, " "},
-		{itemAlias, 0, "alias"},
-		{itemSpace, 0, " "},
-		{itemAccountName, 0, "act1"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAlias, val: "alias"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "act1"},
 		tEOL,
-		{itemSpace, 0, " "},
-		{itemAlias, 0, "alias"},
-		{itemSpace, 0, " "},
-		{itemAccountName, 0, "act2"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAlias, val: "alias"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "act2"},
 		tEOF,
 	}},
 	{"account with payee", "account Account\n payee ^someregex", []item{
-		{itemAccountKeyword, 0, "account"},
-		{itemSpace, 0, " "},
-		{itemAccountName, 0, "Account"},
+		{typ: itemAccountKeyword, val: "account"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Account"},
 		tEOL,
-		{itemSpace, 0, " "},
-		{itemPayee, 0, "payee"},
-		{itemSpace, 0, " "},
-		{itemString, 0, "^someregex"},
+		{typ: itemSpace, val: " "},
+		{typ: itemPayee, val: "payee"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "^someregex"},
 		tEOF,
 	}},
 	{"auto xact", `= `, []item{
-		{itemEqual, 0, "="},
-		{itemSpace, 0, " "},
+		{typ: itemEqual, val: "="},
+		{typ: itemSpace, val: " "},
 		tEOF,
 	}},
 	{"periodic xact with period", `~  monthly ; Note`, []item{
-		{itemTilde, 0, "~"},
-		{itemSpace, 0, "  "},
-		{itemString, 0, "monthly "},
-		{itemNote, 0, "; Note"},
+		{typ: itemTilde, val: "~"},
+		{typ: itemSpace, val: "  "},
+		{typ: itemPeriodKeyword, val: "monthly"},
+		{typ: itemSpace, val: " "},
+		{typ: itemNote, val: "; Note"},
+		tEOF,
+	}},
+	{"periodic xact with date range", "~ monthly from 2016/01/01 to 2016/12/31", []item{
+		{typ: itemTilde, val: "~"},
+		{typ: itemSpace, val: " "},
+		{typ: itemPeriodKeyword, val: "monthly"},
+		{typ: itemSpace, val: " "},
+		{typ: itemFrom, val: "from"},
+		{typ: itemSpace, val: " "},
+		{typ: itemDate, val: "2016/01/01"},
+		{typ: itemSpace, val: " "},
+		{typ: itemTo, val: "to"},
+		{typ: itemSpace, val: " "},
+		{typ: itemDate, val: "2016/12/31"},
+		tEOF,
+	}},
+	{"periodic xact with every N units", "~ every 2 weeks", []item{
+		{typ: itemTilde, val: "~"},
+		{typ: itemSpace, val: " "},
+		{typ: itemEvery, val: "every"},
+		{typ: itemSpace, val: " "},
+		{typ: itemInteger, val: "2"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "weeks"},
+		tEOF,
+	}},
+	{"periodic xact with unrecognized day phrase", "~ yearly on the 15th", []item{
+		{typ: itemTilde, val: "~"},
+		{typ: itemSpace, val: " "},
+		{typ: itemPeriodKeyword, val: "yearly"},
+		{typ: itemSpace, val: " "},
+		{typ: itemOn, val: "on"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "the 15th"},
 		tEOF,
 	}},
 	{"plain xact", "2016/09/09 Payee", []item{
-		{itemDate, 0, "2016/09/09"},
-		{itemSpace, 0, " "},
-		{itemString, 0, "Payee"},
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "Payee"},
 		tEOF,
 	}},
 	{"plain xact eof with note", "2016/09/08 Payee", []item{
-		{itemDate, 0, "2016/09/08"},
-		{itemSpace, 0, " "},
-		{itemString, 0, "Payee"},
+		{typ: itemDate, val: "2016/09/08"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "Payee"},
 		tEOF,
 	}},
 	{"include file", `include "filename"`, []item{
-		{itemInclude, 0, "include"},
-		{itemSpace, 0, " "},
-		{itemString, 0, `"filename"`},
+		{typ: itemInclude, val: "include"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: `"filename"`},
 		tEOF,
 	}},
 	{"periodic xact truncated", `~ `, []item{
-		{itemTilde, 0, "~"},
-		{itemSpace, 0, " "},
+		{typ: itemTilde, val: "~"},
+		{typ: itemSpace, val: " "},
 		tEOF,
 	}},
+	{"account named after a keyword", "account End", []item{
+		{typ: itemAccountKeyword, val: "account"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "End"},
+		tEOF,
+	}},
+	{"alias renaming an account named after a keyword", "account Account\n alias end=Assets:Cash", []item{
+		{typ: itemAccountKeyword, val: "account"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Account"},
+		tEOL,
+		{typ: itemSpace, val: " "},
+		{typ: itemAlias, val: "alias"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "end=Assets:Cash"},
+		tEOF,
+	}},
+	{"posting to an account named after a keyword", "2016/09/09 Payee\n Expenses:Alias  20.00 CAD", []item{
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "Payee"},
+		tEOL,
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Expenses:Alias"},
+		{typ: itemSpace, val: "  "},
+		{typ: itemQuantity, val: "20.00"},
+		{typ: itemSpace, val: " "},
+		{typ: itemCommodity, val: "CAD"},
+		tEOF,
+	}},
+
 	{"periodic xact missing period", `~  ; Note`, []item{
-		{itemTilde, 0, "~"},
-		{itemSpace, 0, "  "},
-		{itemNote, 0, "; Note"},
+		{typ: itemTilde, val: "~"},
+		{typ: itemSpace, val: "  "},
+		{typ: itemNote, val: "; Note"},
 		tEOF,
 	}},
 
 	{"simple transaction", "2016/09/09 Payee\n Account  - 20.00 CAD", []item{
-		{itemDate, 0, "2016/09/09"},
-		{itemSpace, 0, " "},
-		{itemString, 0, "Payee"},
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "Payee"},
 		tEOL,
-		{itemSpace, 0, " "},
-		{itemAccountName, 0, "Account"},
-		{itemSpace, 0, "  "},
-		{itemNeg, 0, "-"},
-		{itemSpace, 0, " "},
-		{itemQuantity, 0, "20.00"},
-		{itemSpace, 0, " "},
-		{itemCommodity, 0, "CAD"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Account"},
+		{typ: itemSpace, val: "  "},
+		{typ: itemNeg, val: "-"},
+		{typ: itemSpace, val: " "},
+		{typ: itemQuantity, val: "20.00"},
+		{typ: itemSpace, val: " "},
+		{typ: itemCommodity, val: "CAD"},
 		tEOF,
 	}},
 	{"less simple transaction", "2016/09/09 * Payee ; So help me God\n    Account  -20.00 CAD\n    Account2:Spaced child:Leaf     CAD 20.00\n", []item{
-		{itemDate, 0, "2016/09/09"},
-		{itemSpace, 0, " "},
-		{itemAsterisk, 0, "*"},
-		{itemSpace, 0, " "},
-		{itemString, 0, "Payee "},
-		{itemNote, 0, "; So help me God"},
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAsterisk, val: "*"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "Payee "},
+		{typ: itemNote, val: "; So help me God"},
 		tEOL,
-		{itemSpace, 0, "    "},
-		{itemAccountName, 0, "Account"},
-		{itemSpace, 0, "  "},
-		{itemNeg, 0, "-"},
-		{itemQuantity, 0, "20.00"},
-		{itemSpace, 0, " "},
-		{itemCommodity, 0, "CAD"},
+		{typ: itemSpace, val: "    "},
+		{typ: itemAccountName, val: "Account"},
+		{typ: itemSpace, val: "  "},
+		{typ: itemNeg, val: "-"},
+		{typ: itemQuantity, val: "20.00"},
+		{typ: itemSpace, val: " "},
+		{typ: itemCommodity, val: "CAD"},
 		tEOL,
-		{itemSpace, 0, "    "},
-		{itemAccountName, 0, "Account2:Spaced child:Leaf"},
-		{itemSpace, 0, "     "},
-		{itemCommodity, 0, "CAD"},
-		{itemSpace, 0, " "},
-		{itemQuantity, 0, "20.00"},
+		{typ: itemSpace, val: "    "},
+		{typ: itemAccountName, val: "Account2:Spaced child:Leaf"},
+		{typ: itemSpace, val: "     "},
+		{typ: itemCommodity, val: "CAD"},
+		{typ: itemSpace, val: " "},
+		{typ: itemQuantity, val: "20.00"},
 		tEOL,
 		tEOF,
 	}},
 
+	{"posting with unit price", "2016/09/09 Payee\n Account  10 AAPL @ $52.00", []item{
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "Payee"},
+		tEOL,
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Account"},
+		{typ: itemSpace, val: "  "},
+		{typ: itemQuantity, val: "10"},
+		{typ: itemSpace, val: " "},
+		{typ: itemCommodity, val: "AAPL"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAt, val: "@"},
+		{typ: itemSpace, val: " "},
+		{typ: itemCommodity, val: "$"},
+		{typ: itemQuantity, val: "52.00"},
+		tEOF,
+	}},
+	{"posting with total price", "2016/09/09 Payee\n Account  10 AAPL @@ $520.00", []item{
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "Payee"},
+		tEOL,
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Account"},
+		{typ: itemSpace, val: "  "},
+		{typ: itemQuantity, val: "10"},
+		{typ: itemSpace, val: " "},
+		{typ: itemCommodity, val: "AAPL"},
+		{typ: itemSpace, val: " "},
+		{typ: itemDoubleAt, val: "@@"},
+		{typ: itemSpace, val: " "},
+		{typ: itemCommodity, val: "$"},
+		{typ: itemQuantity, val: "520.00"},
+		tEOF,
+	}},
+	{"posting with lot price", "2016/09/09 Payee\n Account  10 AAPL {$50.00}", []item{
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "Payee"},
+		tEOL,
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Account"},
+		{typ: itemSpace, val: "  "},
+		{typ: itemQuantity, val: "10"},
+		{typ: itemSpace, val: " "},
+		{typ: itemCommodity, val: "AAPL"},
+		{typ: itemSpace, val: " "},
+		{typ: itemLeftBrace, val: "{"},
+		{typ: itemCommodity, val: "$"},
+		{typ: itemQuantity, val: "50.00"},
+		{typ: itemRightBrace, val: "}"},
+		tEOF,
+	}},
+	{"posting with lot date", "2016/09/09 Payee\n Account  10 AAPL [2016/09/09]", []item{
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "Payee"},
+		tEOL,
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Account"},
+		{typ: itemSpace, val: "  "},
+		{typ: itemQuantity, val: "10"},
+		{typ: itemSpace, val: " "},
+		{typ: itemCommodity, val: "AAPL"},
+		{typ: itemSpace, val: " "},
+		{typ: itemLeftBracket, val: "["},
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemRightBracket, val: "]"},
+		tEOF,
+	}},
+	{"posting with lot note", "2016/09/09 Payee\n Account  10 AAPL (a note)", []item{
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "Payee"},
+		tEOL,
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Account"},
+		{typ: itemSpace, val: "  "},
+		{typ: itemQuantity, val: "10"},
+		{typ: itemSpace, val: " "},
+		{typ: itemCommodity, val: "AAPL"},
+		{typ: itemSpace, val: " "},
+		{typ: itemLeftParen, val: "("},
+		{typ: itemString, val: "a note"},
+		{typ: itemRightParen, val: ")"},
+		tEOF,
+	}},
+	{"posting with lot price and a price, selling a lot", "2016/09/09 Payee\n Account  10 AAPL {$50.00} @ $52.00", []item{
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "Payee"},
+		tEOL,
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Account"},
+		{typ: itemSpace, val: "  "},
+		{typ: itemQuantity, val: "10"},
+		{typ: itemSpace, val: " "},
+		{typ: itemCommodity, val: "AAPL"},
+		{typ: itemSpace, val: " "},
+		{typ: itemLeftBrace, val: "{"},
+		{typ: itemCommodity, val: "$"},
+		{typ: itemQuantity, val: "50.00"},
+		{typ: itemRightBrace, val: "}"},
+		{typ: itemSpace, val: " "},
+		{typ: itemAt, val: "@"},
+		{typ: itemSpace, val: " "},
+		{typ: itemCommodity, val: "$"},
+		{typ: itemQuantity, val: "52.00"},
+		tEOF,
+	}},
+	{"posting with quoted commodity", "2016/09/09 Payee\n Account  10 \"MUTF123\"", []item{
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemSpace, val: " "},
+		{typ: itemString, val: "Payee"},
+		tEOL,
+		{typ: itemSpace, val: " "},
+		{typ: itemAccountName, val: "Account"},
+		{typ: itemSpace, val: "  "},
+		{typ: itemQuantity, val: "10"},
+		{typ: itemSpace, val: " "},
+		{typ: itemCommodity, val: `"MUTF123"`},
+		tEOF,
+	}},
+
 	// errors
 
 	{"plain xact eof", "2016/09/09", []item{
-		{itemDate, 0, "2016/09/09"},
-		{itemError, 0, "unexpected end-of-file"},
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemError, val: "unexpected end-of-file"},
 	}},
 	{"plain xact eof with note", "2016/09/09\n", []item{
-		{itemDate, 0, "2016/09/09"},
-		{itemError, 0, "unexpected end-of-line"},
+		{typ: itemDate, val: "2016/09/09"},
+		{typ: itemError, val: "unexpected end-of-line"},
 	}},
 	{"erroneous date non-digit", "2016/09eee\n", []item{
-		{itemError, 0, "date format error, expects YYYY-MM-DD with '/', '-' or '.' as separators, received character U+0065 'e'"},
+		{typ: itemError, val: "date format error, expects YYYY-MM-DD with '/', '-' or '.' as separators, received character U+0065 'e'"},
 	}},
 	{"erroneous date", "2016/099/08 Payee", []item{
-		{itemError, 0, "date format error, expects YYYY-MM-DD with '/', '-' or '.' as separators, received character U+0039 '9'"},
+		{typ: itemError, val: "date format error, expects YYYY-MM-DD with '/', '-' or '.' as separators, received character U+0039 '9'"},
 	}},
 	{"erroneous short date", "2016/09", []item{
-		{itemError, 0, "date format error, expects YYYY-MM-DD with '/', '-' or '.' as separators, received character U+FFFFFFFFFFFFFFFF"},
+		{typ: itemError, val: "date format error, expects YYYY-MM-DD with '/', '-' or '.' as separators, received character U+FFFFFFFFFFFFFFFF"},
 	}},
 }
 
@@ -210,6 +405,127 @@ func collect(t *lexTest) (items []item) {
 	return
 }
 
+// TestLexReader confirms that lexReader, which grows its buffer on demand
+// from an io.Reader instead of requiring the whole input up front, produces
+// the same token stream as lex for the same text — both fed straight
+// through a strings.Reader and, worst case, one byte at a time.
+func TestLexReader(t *testing.T) {
+	var test *lexTest
+	for i := range lexTests {
+		if lexTests[i].name == "less simple transaction" {
+			test = &lexTests[i]
+			break
+		}
+	}
+	if test == nil {
+		t.Fatal("fixture \"less simple transaction\" not found in lexTests")
+	}
+
+	want := collect(test)
+
+	readers := map[string]io.Reader{
+		"strings.Reader":       strings.NewReader(test.input),
+		"iotest.OneByteReader": iotest.OneByteReader(strings.NewReader(test.input)),
+	}
+	for name, r := range readers {
+		l := lexReader(test.name, r)
+		var got []item
+		for {
+			it := l.nextItem()
+			got = append(got, it)
+			if it.typ == itemEOF || it.typ == itemError {
+				break
+			}
+		}
+		if !equal(got, want, true) {
+			t.Errorf("lexReader via %s: got\n\t%+v\nexpected\n\t%v", name, got, want)
+		}
+	}
+}
+
+// TestLexPushPop confirms that push/pop are symmetric: popping returns the
+// most recently pushed state, in last-in-first-out order. It builds a
+// lexer directly, bypassing lex()'s background goroutine, since push/pop
+// themselves don't need a running scan.
+func TestLexPushPop(t *testing.T) {
+	l := &lexer{items: make(chan item, 1)}
+
+	l.push(lexJournal)
+	l.push(lexPostings)
+	l.push(lexPostingAmount)
+
+	want := []stateFn{lexPostingAmount, lexPostings, lexJournal}
+	for i, w := range want {
+		if got := l.pop(); !sameStateFn(got, w) {
+			t.Errorf("pop %d: got a different state function than expected", i)
+		}
+	}
+}
+
+// TestLexPopUnbalanced confirms that popping an empty stack is reported via
+// errorf rather than panicking.
+func TestLexPopUnbalanced(t *testing.T) {
+	l := &lexer{items: make(chan item, 1)}
+
+	if state := l.pop(); state != nil {
+		t.Fatalf("pop of empty stack: got a state, want nil to terminate the lex")
+	}
+	got := <-l.items
+	if got.typ != itemError {
+		t.Fatalf("pop of empty stack: got item type %v, want itemError", got.typ)
+	}
+}
+
+// sameStateFn reports whether a and b are the same state function; stateFn
+// values aren't comparable with ==, so this compares their entry points.
+func sameStateFn(a, b stateFn) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// TestLexLineNumber confirms that items emitted partway through the input
+// carry the line on which they actually start.
+func TestLexLineNumber(t *testing.T) {
+	input := "account A\n alias a1\n alias a2"
+	l := lex("linecol", input)
+	var got []item
+	for {
+		it := l.nextItem()
+		got = append(got, it)
+		if it.typ == itemEOF || it.typ == itemError {
+			break
+		}
+	}
+	var sawLine3Alias bool
+	for _, it := range got {
+		if it.typ == itemAlias && it.line == 3 {
+			sawLine3Alias = true
+		}
+	}
+	if !sawLine3Alias {
+		t.Errorf("test %q: expected an alias token on line 3, got %+v", "line number", got)
+	}
+}
+
+// TestLexErrorPosition confirms that errorf attaches the line and column of
+// the offending token, not just its byte offset.
+func TestLexErrorPosition(t *testing.T) {
+	input := "account A\n $ bad"
+	l := lex("errpos", input)
+	var last item
+	for {
+		last = l.nextItem()
+		if last.typ == itemEOF || last.typ == itemError {
+			break
+		}
+	}
+	if last.typ != itemError {
+		t.Fatalf("test %q: expected a lex error, got %+v", "error position", last)
+	}
+	if last.line != 2 || last.col != 2 {
+		t.Errorf("test %q: expected error at line 2, col 2, got line %d, col %d", "error position", last.line, last.col)
+	}
+}
+
 func equal(i1, i2 []item, checkPos bool) bool {
 	if len(i1) != len(i2) {
 		return false